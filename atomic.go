@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// finalize 校验partPath内容后，将其原子替换到LocalPath。KeepBackups大于0且LocalPath已存在时，
+// 会先把已有的备份依次滚动（LocalPath.N -> LocalPath.(N+1)），再把当前LocalPath备份为LocalPath.1，
+// 最后才rename partPath，返回的prevPath即为该备份路径，供UpdateCallback给出回滚依据；
+// 若校验失败会删除partPath并返回错误，不会影响已有的LocalPath
+func (d *Downloader) finalize(partPath string) (string, error) {
+	if err := d.verifyChecksum(partPath); err != nil {
+		os.Remove(partPath)
+		return "", err
+	}
+
+	prevPath := ""
+	if d.KeepBackups > 0 {
+		if _, err := os.Stat(d.LocalPath); err == nil {
+			for i := d.KeepBackups - 1; i >= 1; i-- {
+				os.Rename(d.backupPath(i), d.backupPath(i+1))
+			}
+			backup := d.backupPath(1)
+			if err := os.Rename(d.LocalPath, backup); err != nil {
+				return "", fmt.Errorf("rotate backup fail: %s", err.Error())
+			}
+			prevPath = backup
+		}
+	}
+	if err := os.Rename(partPath, d.LocalPath); err != nil {
+		return "", fmt.Errorf("rename part file fail: %s", err.Error())
+	}
+	return prevPath, nil
+}
+
+func (d *Downloader) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", d.LocalPath, n)
+}
+
+// verifyChecksum 校验path内容的sha256，ExpectedChecksum为空时改为尝试拉取RemoteURL+".sha256"，
+// 两者都取不到（包括sibling响应不是合法的sha256十六进制值）时视为无需校验
+func (d *Downloader) verifyChecksum(path string) error {
+	expected := d.ExpectedChecksum
+	if expected == "" && d.RemoteURL != "" {
+		if sum, err := d.fetchSiblingChecksum(); err == nil {
+			expected = sum
+		}
+	}
+	if expected == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch: expected=%s, actual=%s", expected, actual)
+	}
+	return nil
+}
+
+func (d *Downloader) fetchSiblingChecksum() (string, error) {
+	req, err := http.NewRequest(http.MethodGet, d.RemoteURL+".sha256", nil)
+	if err != nil {
+		return "", err
+	}
+	d.decorateRequest(req)
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch sha256 fail: unexpected status code %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// 兼容sha256sum输出格式（"<hex>  <filename>"），只取第一个字段，且必须是合法的sha256十六进制值
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("fetch sha256 fail: empty checksum file")
+	}
+	if decoded, err := hex.DecodeString(fields[0]); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("fetch sha256 fail: response is not a sha256 hex digest")
+	}
+	return fields[0], nil
+}
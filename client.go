@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// httpClient 返回用于发起远程请求的*http.Client。HTTPClient字段非空时直接使用它（此时由调用方
+// 自行负责代理、超时等配置）；否则按Timeout、Proxy和SafeMode构造一个默认client，SafeMode开启时
+// （默认）该client会拦截重定向并拒绝连接到BlockedCIDRs覆盖的内网地址
+func (d *Downloader) httpClient() *http.Client {
+	if d.client != nil {
+		return d.client
+	}
+	if d.HTTPClient != nil {
+		d.client = d.HTTPClient
+		return d.client
+	}
+
+	proxy := d.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	transport := &http.Transport{Proxy: proxy}
+	client := &http.Client{Transport: transport}
+
+	if !d.DisableSafeMode {
+		blocked := d.BlockedCIDRs
+		if blocked == nil {
+			blocked = defaultBlockedCIDRs
+		}
+		dialer := &net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil {
+					return &net.AddrError{Err: "invalid remote address", Addr: address}
+				}
+				for _, cidr := range blocked {
+					if cidr.Contains(ip) {
+						return &BlockedAddressError{Address: ip.String()}
+					}
+				}
+				return nil
+			},
+		}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		// 不自动跟随重定向，将重定向响应原样交回调用方处理，避免跳转到内网地址后被自动请求
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	if d.Timeout > 0 {
+		client.Timeout = d.Timeout
+	}
+	d.client = client
+	return d.client
+}
+
+// decorateRequest 在请求发出前应用RequestDecorator，用于附加Authorization、自定义User-Agent
+// 或Cookie等无需为整个Downloader包一层的场景
+func (d *Downloader) decorateRequest(req *http.Request) {
+	if d.RequestDecorator != nil {
+		d.RequestDecorator(req)
+	}
+}
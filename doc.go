@@ -8,7 +8,7 @@ Example:
         RemoteURL: "https://user.ipip.net/download.php?token=",
         CheckETag: true,
         ErrorCallback: func(err error) { fmt.Fprintf(os.Stderr, "%s", err.Error()) },
-        UpdateCallback: func(path string) { fmt.Println("file updated:", path) },
+        UpdateCallback: func(path, prevPath string) { fmt.Println("file updated:", path) },
     }
     d.EnsureLocal()
     go d.StartWatch()
@@ -1,11 +1,16 @@
 package downloader
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -28,14 +33,71 @@ type Downloader struct {
 	// 是否检查远程下载中的ETag字段，若远程下载服务器出现异常导致缺少ETag字段，可将此字段设置为false以退化为周期性强制更新
 	CheckETag bool
 
+	// 是否检查远程响应中的Last-Modified字段，开启后每次轮询都会在同一个conditional GET请求上
+	// 同时携带If-None-Match和If-Modified-Since，用于服务器不返回ETag、只提供Last-Modified的场景，
+	// Last-Modified值持久化在LocalPath+".meta"
+	CheckLastModified bool
+
+	// 并发下载连接数，大于1且远程服务器支持Range请求时按分块并发下载，否则退化为单连接下载
+	Connections int
+
+	// 分块大小，为0时按Connections均分文件大小
+	ChunkSize int64
+
 	// 错误事件回调函数，参数为错误对象
 	ErrorCallback func(error)
 
-	// 更新事件回调函数，参数为数据文件路径
-	UpdateCallback func(string)
+	// 更新事件回调函数，参数为新的数据文件路径，以及被替换版本的备份路径（KeepBackups为0
+	// 或不存在旧版本时为空字符串）
+	UpdateCallback func(newPath, prevPath string)
+
+	// ExpectedChecksum 是预期的文件sha256值（十六进制），非空时下载完成后会校验part文件内容，
+	// 不一致则报错且不会替换LocalPath；为空时会尝试拉取RemoteURL+".sha256"作为预期值
+	ExpectedChecksum string
+
+	// KeepBackups 保留的历史版本数量，大于0时替换LocalPath前会将已有版本依次滚动备份为
+	// LocalPath.1、LocalPath.2……，为运营人员在收到错误数据时提供回滚路径
+	KeepBackups int
+
+	// 下载进度回调函数，参数为已下载字节数和总字节数，总字节数未知时为0
+	ProgressCallback func(downloaded, total int64)
+
+	// 状态变化回调函数，参数为变化后的状态
+	StatusCallback func(Status)
+
+	// DisableSafeMode 关闭SafeMode，SafeMode默认开启，会拦截跳转到BlockedCIDRs覆盖网段的重定向
+	// 以及直接连接BlockedCIDRs覆盖网段，用于防止RemoteURL被配置为用户可控地址时引发SSRF
+	DisableSafeMode bool
+
+	// BlockedCIDRs 是SafeMode下禁止连接的网段列表，为nil时使用覆盖RFC1918私有地址、回环地址、
+	// 链路本地地址的默认列表
+	BlockedCIDRs []*net.IPNet
+
+	// HTTPClient 是发起远程请求使用的client，为空时按Timeout、Proxy和SafeMode构造一个默认client
+	HTTPClient *http.Client
+
+	// RequestDecorator 在每个远程请求发出前被调用，可用于附加Authorization、自定义User-Agent
+	// 或Cookie等，无需为此包一层HTTPClient
+	RequestDecorator func(*http.Request)
+
+	// Timeout 是HTTPClient为空时构造的默认client的超时时间，为0表示不设置超时
+	Timeout time.Duration
+
+	// Proxy 是HTTPClient为空时构造的默认client使用的代理函数，为空时按HTTP_PROXY/HTTPS_PROXY
+	// 环境变量取值（即http.ProxyFromEnvironment）
+	Proxy func(*http.Request) (*url.URL, error)
+
+	etag         string
+	lastModified string
+	prevPath     string
+	watching     bool
+	client       *http.Client
 
-	etag     string
-	watching bool
+	// mu 保护fetcher和pauseCh：两者由watchLocal/watchRemote所在的goroutine读取，
+	// 又由调用方goroutine通过Pause/Resume/EnsureLocal写入，需要同步
+	mu      sync.Mutex
+	fetcher Fetcher
+	pauseCh chan struct{}
 }
 
 // EnsureLocal 用于在首次加载前确保本地文件存在
@@ -48,10 +110,18 @@ func (d *Downloader) EnsureLocal() error {
 			}
 			d.etag = string(etag)
 		}
+		if d.CheckLastModified {
+			if data, err := ioutil.ReadFile(d.LocalPath + ".meta"); err == nil {
+				var meta fetchMeta
+				if err := json.Unmarshal(data, &meta); err == nil {
+					d.lastModified = meta.LastModified
+				}
+			}
+		}
 		return nil
 	}
 	if err := d.download(); err != nil {
-		return fmt.Errorf("download fail: %s", err.Error())
+		return fmt.Errorf("download fail: %w", err)
 	}
 	return nil
 }
@@ -74,15 +144,98 @@ func (d *Downloader) StopWatch() {
 	d.watching = false
 }
 
+// Pause 暂停正在进行的拉取，并挂起watchRemote/watchLocal的轮询循环，直到调用Resume。
+// 轮询循环的挂起（pauseCh）与Fetcher自身的Started/Paused状态是两回事：多数情况下Pause发生在
+// 两次轮询之间，此时Fetcher处于Done，并没有正在进行的拉取可暂停，因此只有Fetcher确实处于
+// StatusStarted时才转发给它，其余情况下只挂起轮询循环，不当作错误
+func (d *Downloader) Pause() error {
+	d.mu.Lock()
+	if d.pauseCh != nil {
+		d.mu.Unlock()
+		return errors.New("already paused")
+	}
+	d.pauseCh = make(chan struct{})
+	fetcher := d.fetcher
+	d.mu.Unlock()
+	if fetcher != nil && fetcher.Status() == StatusStarted {
+		return fetcher.Pause()
+	}
+	return nil
+}
+
+// Resume 恢复被Pause挂起的轮询循环
+func (d *Downloader) Resume() error {
+	d.mu.Lock()
+	if d.pauseCh == nil {
+		d.mu.Unlock()
+		return errors.New("not paused")
+	}
+	close(d.pauseCh)
+	d.pauseCh = nil
+	fetcher := d.fetcher
+	d.mu.Unlock()
+	if fetcher != nil && fetcher.Status() == StatusPaused {
+		return fetcher.Resume()
+	}
+	return nil
+}
+
+// Status 返回当前Fetcher所处的状态
+func (d *Downloader) Status() Status {
+	d.mu.Lock()
+	fetcher := d.fetcher
+	d.mu.Unlock()
+	if fetcher == nil {
+		return StatusReady
+	}
+	return fetcher.Status()
+}
+
+func (d *Downloader) waitIfPaused() {
+	d.mu.Lock()
+	ch := d.pauseCh
+	d.mu.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
+
+func (d *Downloader) ensureFetcher() (Fetcher, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fetcher != nil {
+		return d.fetcher, nil
+	}
+	if d.RemoteURL == "" {
+		d.fetcher = newFileFetcher(d)
+		return d.fetcher, nil
+	}
+	fetcher, err := buildFetcher(d, d.RemoteURL)
+	if err != nil {
+		return nil, err
+	}
+	d.fetcher = fetcher
+	return d.fetcher, nil
+}
+
 func (d *Downloader) watchLocal() {
-	info, _ := os.Stat(d.LocalPath)
-	ts := info.ModTime()
+	fetcher, err := d.ensureFetcher()
+	if err != nil {
+		d.onError(err)
+		return
+	}
+	var ts time.Time
+	if resource, err := fetcher.Resolve(d.LocalPath); err == nil {
+		ts = resource.ModTime
+	}
 	time.Sleep(d.Interval)
 	for d.watching {
-		info, err := os.Stat(d.LocalPath)
+		d.waitIfPaused()
+		resource, err := fetcher.Resolve(d.LocalPath)
 		if err != nil {
 			d.onError(err)
-		} else if info.ModTime().After(ts) {
+		} else if resource.ModTime.After(ts) {
+			ts = resource.ModTime
 			d.onUpdate()
 		}
 		time.Sleep(d.Interval)
@@ -91,6 +244,7 @@ func (d *Downloader) watchLocal() {
 
 func (d *Downloader) watchRemote() {
 	for d.watching {
+		d.waitIfPaused()
 		if err := d.download(); err == errNotModified {
 			// do nothing
 		} else if err != nil {
@@ -110,52 +264,27 @@ func (d *Downloader) onError(err error) {
 
 func (d *Downloader) onUpdate() {
 	if d.UpdateCallback != nil {
-		d.UpdateCallback(d.LocalPath)
+		d.UpdateCallback(d.LocalPath, d.prevPath)
 	}
 
 }
 
-func (d *Downloader) checkRemoteModification() (bool, error) {
-	resp, err := http.Head(d.RemoteURL)
-	if err != nil {
-		return true, err
+func (d *Downloader) onProgress(downloaded, total int64) {
+	if d.ProgressCallback != nil {
+		d.ProgressCallback(downloaded, total)
 	}
-	defer resp.Body.Close()
-	etag := resp.Header.Get("ETag")
-	if etag == "" {
-		return true, errNoETag
+}
+
+func (d *Downloader) onStatus(status Status) {
+	if d.StatusCallback != nil {
+		d.StatusCallback(status)
 	}
-	return d.etag != etag, nil
 }
 
 func (d *Downloader) download() error {
-	if d.RemoteURL == "" {
-		return errors.New("remote url is unset")
-	}
-	// check remote modification first
-	if d.CheckETag {
-		if modified, err := d.checkRemoteModification(); err != nil {
-			return fmt.Errorf("check remote modification fail: %s", err.Error())
-		} else if !modified {
-			return errNotModified
-		}
-	}
-	// download remote content
-	resp, err := http.Get(d.RemoteURL)
-	if err != nil {
-		return fmt.Errorf("download fail: %s", err.Error())
-	}
-	defer resp.Body.Close()
-	content, err := ioutil.ReadAll(resp.Body)
+	fetcher, err := d.ensureFetcher()
 	if err != nil {
-		return fmt.Errorf("read response body fail: %s", err.Error())
+		return fmt.Errorf("resolve fetcher fail: %s", err.Error())
 	}
-	if err := ioutil.WriteFile(d.LocalPath, content, 0755); err != nil {
-		return fmt.Errorf("save local file fail: %s", err.Error())
-	}
-	if err := ioutil.WriteFile(d.LocalPath+".etag", []byte(resp.Header.Get("ETag")), 0755); err != nil {
-		return fmt.Errorf("save local etag file fail: %s", err.Error())
-	}
-	d.etag = resp.Header.Get("ETag")
-	return nil
+	return fetcher.Start(context.Background())
 }
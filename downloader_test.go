@@ -2,9 +2,18 @@ package downloader
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -87,6 +96,8 @@ func TestEnsureLocalCase2(t *testing.T) {
 		LocalPath: "test.txt",
 		RemoteURL: "http://127.0.0.1:8787",
 		CheckETag: true,
+		// 测试服务器跑在回环地址上，SafeMode默认会拦截，这里关闭以便测试
+		DisableSafeMode: true,
 	}
 	if err := d.EnsureLocal(); err != nil {
 		t.Error("EnsureLocal fail:", err.Error())
@@ -117,7 +128,7 @@ func TestWatchLocal(t *testing.T) {
 	d := &Downloader{
 		LocalPath: "test.txt",
 		Interval:  time.Microsecond * 500,
-		UpdateCallback: func(path string) {
+		UpdateCallback: func(path, prevPath string) {
 			updateEvent <- path
 		},
 		ErrorCallback: func(err error) {
@@ -150,6 +161,603 @@ func TestWatchLocal(t *testing.T) {
 	}
 }
 
+// rangeServer 是支持Range请求的测试服务器，用于验证downloadChunked的分块下载与
+// errgroup取消行为，failOffset非负时该偏移的第一次请求会返回500，模拟单个分块下载失败
+type rangeServer struct {
+	content    []byte
+	etag       string
+	failOffset int64
+	failed     bool
+}
+
+func (s *rangeServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" {
+		resp.WriteHeader(http.StatusOK)
+		resp.Write(s.content)
+		return
+	}
+	var start, end int64
+	fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
+	if s.failOffset >= 0 && start == s.failOffset && !s.failed {
+		s.failed = true
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if end >= int64(len(s.content)) {
+		end = int64(len(s.content)) - 1
+	}
+	resp.Header().Set("Accept-Ranges", "bytes")
+	resp.Header().Set("ETag", s.etag)
+	resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.content)))
+	resp.WriteHeader(http.StatusPartialContent)
+	resp.Write(s.content[start : end+1])
+}
+
+func TestDownloadChunked(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	rs := &rangeServer{content: content, etag: "CHUNK_ETAG", failOffset: -1}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	os.Remove("chunked.dat")
+	defer os.Remove("chunked.dat")
+	defer os.Remove("chunked.dat.progress")
+	defer os.Remove("chunked.dat.etag")
+
+	d := &Downloader{
+		LocalPath:       "chunked.dat",
+		RemoteURL:       srv.URL,
+		Connections:     4,
+		DisableSafeMode: true,
+	}
+	if err := d.EnsureLocal(); err != nil {
+		t.Error("EnsureLocal fail:", err.Error())
+		t.FailNow()
+	}
+	got, err := ioutil.ReadFile("chunked.dat")
+	if err != nil {
+		t.Error("read chunked.dat fail:", err.Error())
+		t.FailNow()
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("unexpected chunked download content")
+		t.FailNow()
+	}
+	if _, err := os.Stat("chunked.dat.progress"); err == nil {
+		t.Error("progress file should be removed after successful download")
+		t.FailNow()
+	}
+}
+
+func TestDownloadChunkedFailureKeepsProgress(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), 1000)
+	rs := &rangeServer{content: content, etag: "CHUNK_ETAG2", failOffset: int64(len(content)) / 2}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	os.Remove("chunked2.dat")
+	os.Remove("chunked2.dat.part")
+	os.Remove("chunked2.dat.progress")
+	defer os.Remove("chunked2.dat.part")
+	defer os.Remove("chunked2.dat.progress")
+
+	d := &Downloader{
+		LocalPath:       "chunked2.dat",
+		RemoteURL:       srv.URL,
+		Connections:     2,
+		DisableSafeMode: true,
+	}
+	if err := d.EnsureLocal(); err == nil {
+		t.Error("EnsureLocal pass unexpected: one chunk should fail")
+		t.FailNow()
+	}
+	if _, err := os.Stat("chunked2.dat"); err == nil {
+		t.Error("chunked2.dat should not exist after a failed chunk download")
+		t.FailNow()
+	}
+	if _, err := os.Stat("chunked2.dat.progress"); err != nil {
+		t.Error("progress file should be preserved for resume after a failed chunk")
+		t.FailNow()
+	}
+}
+
+// conditionalServer 是支持If-Modified-Since的测试服务器，用于验证CheckLastModified开启时
+// 的conditional GET行为；它不提供".sha256"校验文件，requests只统计对数据文件本身的请求
+type conditionalServer struct {
+	content      []byte
+	lastModified string
+	requests     int
+}
+
+func (s *conditionalServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, ".sha256") {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.requests++
+	if req.Header.Get("If-Modified-Since") == s.lastModified {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp.Header().Set("Last-Modified", s.lastModified)
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(s.content)
+}
+
+func TestConditionalGetLastModified(t *testing.T) {
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	cs := &conditionalServer{content: []byte("cond content"), lastModified: lastModified}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+
+	os.Remove("cond.dat")
+	defer os.Remove("cond.dat")
+	defer os.Remove("cond.dat.etag")
+	defer os.Remove("cond.dat.meta")
+
+	d := &Downloader{
+		LocalPath:         "cond.dat",
+		RemoteURL:         srv.URL,
+		CheckLastModified: true,
+		DisableSafeMode:   true,
+	}
+	if err := d.EnsureLocal(); err != nil {
+		t.Error("EnsureLocal fail:", err.Error())
+		t.FailNow()
+	}
+	content, err := ioutil.ReadFile("cond.dat")
+	if err != nil {
+		t.Error("read cond.dat fail:", err.Error())
+		t.FailNow()
+	}
+	if !bytes.Equal(content, cs.content) {
+		t.Error("unexpected cond.dat content")
+		t.FailNow()
+	}
+	metaData, err := ioutil.ReadFile("cond.dat.meta")
+	if err != nil {
+		t.Error("read cond.dat.meta fail:", err.Error())
+		t.FailNow()
+	}
+	var meta fetchMeta
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		t.Error("unmarshal cond.dat.meta fail:", err.Error())
+		t.FailNow()
+	}
+	if meta.LastModified != lastModified {
+		t.Errorf("unexpected last modified in meta: expected=%s, actual=%s", lastModified, meta.LastModified)
+		t.FailNow()
+	}
+
+	if err := d.download(); err != errNotModified {
+		t.Errorf("expected errNotModified on unchanged content, got: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestConditionalGetSingleRequestPerPoll(t *testing.T) {
+	// 内容应当由conditional GET的响应body直接落盘，不应该为了拿内容再单独发起一次GET
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	cs := &conditionalServer{content: []byte("single request content"), lastModified: lastModified}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+
+	os.Remove("singlereq.dat")
+	defer os.Remove("singlereq.dat")
+	defer os.Remove("singlereq.dat.etag")
+	defer os.Remove("singlereq.dat.meta")
+
+	d := &Downloader{
+		LocalPath:         "singlereq.dat",
+		RemoteURL:         srv.URL,
+		CheckLastModified: true,
+		DisableSafeMode:   true,
+	}
+	if err := d.EnsureLocal(); err != nil {
+		t.Error("EnsureLocal fail:", err.Error())
+		t.FailNow()
+	}
+	if cs.requests != 1 {
+		t.Errorf("expected exactly one request for the initial download, got %d", cs.requests)
+		t.FailNow()
+	}
+}
+
+func TestConditionalGetDoesNotPersistMetaOnDownloadFailure(t *testing.T) {
+	// checkRemoteModificationGet探测到内容已更新后，若真正落盘失败（这里用checksum校验失败模拟），
+	// .meta和内存里的lastModified都不应该被更新，否则下一次轮询会因为携带了新的If-Modified-Since
+	// 被服务端直接返回304，更新永久丢失
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	cs := &conditionalServer{content: []byte("checksum guarded content"), lastModified: lastModified}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+
+	os.Remove("guarded.dat")
+	defer os.Remove("guarded.dat")
+	defer os.Remove("guarded.dat.etag")
+	defer os.Remove("guarded.dat.meta")
+	defer os.Remove("guarded.dat.part")
+
+	d := &Downloader{
+		LocalPath:         "guarded.dat",
+		RemoteURL:         srv.URL,
+		CheckLastModified: true,
+		ExpectedChecksum:  strings.Repeat("0", 64),
+		DisableSafeMode:   true,
+	}
+	if err := d.EnsureLocal(); err == nil {
+		t.Error("EnsureLocal pass unexpected: checksum should fail")
+		t.FailNow()
+	}
+	if _, err := os.Stat("guarded.dat.meta"); err == nil {
+		t.Error(".meta should not be persisted when the download itself fails")
+		t.FailNow()
+	}
+	if d.lastModified != "" {
+		t.Error("in-memory lastModified should not be updated when the download fails")
+		t.FailNow()
+	}
+}
+
+// checksumServer 在RemoteURL路径下提供内容，并在RemoteURL+".sha256"路径下提供其校验值，
+// 用于验证ExpectedChecksum校验及未设置时回退拉取sha256 sibling文件的行为
+type checksumServer struct {
+	content  []byte
+	checksum string
+}
+
+func (s *checksumServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, ".sha256") {
+		resp.WriteHeader(http.StatusOK)
+		resp.Write([]byte(s.checksum))
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(s.content)
+}
+
+func TestFinalizeChecksumMismatch(t *testing.T) {
+	cs := &checksumServer{content: []byte("checksum content")}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+
+	os.Remove("checksum.dat")
+	defer os.Remove("checksum.dat")
+	defer os.Remove("checksum.dat.etag")
+	defer os.Remove("checksum.dat.part")
+
+	d := &Downloader{
+		LocalPath:        "checksum.dat",
+		RemoteURL:        srv.URL,
+		ExpectedChecksum: strings.Repeat("0", 64),
+		DisableSafeMode:  true,
+	}
+	if err := d.EnsureLocal(); err == nil {
+		t.Error("EnsureLocal pass unexpected: checksum mismatch")
+		t.FailNow()
+	}
+	if _, err := os.Stat("checksum.dat"); err == nil {
+		t.Error("checksum.dat should not exist after checksum mismatch")
+		t.FailNow()
+	}
+	if _, err := os.Stat("checksum.dat.part"); err == nil {
+		t.Error("checksum.dat.part should be removed after checksum mismatch")
+		t.FailNow()
+	}
+}
+
+func TestFinalizeSiblingChecksum(t *testing.T) {
+	content := []byte("sibling checksum content")
+	sum := sha256.Sum256(content)
+	cs := &checksumServer{content: content, checksum: hex.EncodeToString(sum[:])}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+
+	os.Remove("sibling.dat")
+	defer os.Remove("sibling.dat")
+	defer os.Remove("sibling.dat.etag")
+
+	d := &Downloader{
+		LocalPath:       "sibling.dat",
+		RemoteURL:       srv.URL,
+		DisableSafeMode: true,
+	}
+	if err := d.EnsureLocal(); err != nil {
+		t.Error("EnsureLocal fail:", err.Error())
+		t.FailNow()
+	}
+	got, err := ioutil.ReadFile("sibling.dat")
+	if err != nil {
+		t.Error("read sibling.dat fail:", err.Error())
+		t.FailNow()
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("unexpected sibling.dat content")
+		t.FailNow()
+	}
+}
+
+func TestBackupRotation(t *testing.T) {
+	cs := &checksumServer{content: []byte("v1")}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+
+	base := "rotate.dat"
+	os.Remove(base)
+	os.Remove(base + ".1")
+	os.Remove(base + ".2")
+	defer os.Remove(base)
+	defer os.Remove(base + ".etag")
+	defer os.Remove(base + ".1")
+	defer os.Remove(base + ".2")
+
+	d := &Downloader{
+		LocalPath:       base,
+		RemoteURL:       srv.URL,
+		KeepBackups:     2,
+		DisableSafeMode: true,
+	}
+	if err := d.EnsureLocal(); err != nil {
+		t.Error("EnsureLocal fail:", err.Error())
+		t.FailNow()
+	}
+
+	cs.content = []byte("v2")
+	if err := d.download(); err != nil {
+		t.Error("second download fail:", err.Error())
+		t.FailNow()
+	}
+	if v1, err := ioutil.ReadFile(base + ".1"); err != nil || string(v1) != "v1" {
+		t.Errorf("unexpected backup content: err=%v, content=%s", err, v1)
+		t.FailNow()
+	}
+
+	cs.content = []byte("v3")
+	if err := d.download(); err != nil {
+		t.Error("third download fail:", err.Error())
+		t.FailNow()
+	}
+	if v2, err := ioutil.ReadFile(base + ".2"); err != nil || string(v2) != "v1" {
+		t.Errorf("unexpected rotated backup content: err=%v, content=%s", err, v2)
+		t.FailNow()
+	}
+	if v1, err := ioutil.ReadFile(base + ".1"); err != nil || string(v1) != "v2" {
+		t.Errorf("unexpected backup content: err=%v, content=%s", err, v1)
+		t.FailNow()
+	}
+	if current, err := ioutil.ReadFile(base); err != nil || string(current) != "v3" {
+		t.Errorf("unexpected current content: err=%v, content=%s", err, current)
+		t.FailNow()
+	}
+}
+
+func TestCustomHTTPClient(t *testing.T) {
+	// HTTPClient非空时应当原样使用，不再套用Timeout/Proxy/SafeMode
+	custom := &http.Client{}
+	d := &Downloader{HTTPClient: custom}
+	if got := d.httpClient(); got != custom {
+		t.Error("httpClient should return the injected HTTPClient as-is")
+		t.FailNow()
+	}
+}
+
+func TestCustomProxy(t *testing.T) {
+	called := false
+	proxyFunc := func(req *http.Request) (*url.URL, error) {
+		called = true
+		return nil, nil
+	}
+	d := &Downloader{Proxy: proxyFunc, DisableSafeMode: true}
+	transport, ok := d.httpClient().Transport.(*http.Transport)
+	if !ok {
+		t.Error("expected default client to use *http.Transport")
+		t.FailNow()
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if _, err := transport.Proxy(req); err != nil {
+		t.Error("Proxy fail:", err.Error())
+		t.FailNow()
+	}
+	if !called {
+		t.Error("expected custom Proxy function to be used")
+		t.FailNow()
+	}
+}
+
+type headerCheckServer struct {
+	content []byte
+	seen    string
+}
+
+func (s *headerCheckServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	s.seen = req.Header.Get("X-Custom-Token")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(s.content)
+}
+
+func TestRequestDecorator(t *testing.T) {
+	hs := &headerCheckServer{content: []byte("decorated")}
+	srv := httptest.NewServer(hs)
+	defer srv.Close()
+
+	os.Remove("decorated.dat")
+	defer os.Remove("decorated.dat")
+	defer os.Remove("decorated.dat.etag")
+
+	d := &Downloader{
+		LocalPath:       "decorated.dat",
+		RemoteURL:       srv.URL,
+		DisableSafeMode: true,
+		RequestDecorator: func(req *http.Request) {
+			req.Header.Set("X-Custom-Token", "secret")
+		},
+	}
+	if err := d.EnsureLocal(); err != nil {
+		t.Error("EnsureLocal fail:", err.Error())
+		t.FailNow()
+	}
+	if hs.seen != "secret" {
+		t.Errorf("expected decorated header to reach server, got: %q", hs.seen)
+		t.FailNow()
+	}
+}
+
+func TestSafeModeBlocksLoopback(t *testing.T) {
+	// SafeMode默认开启，回环地址落在默认BlockedCIDRs内，应当拦截并返回可识别的错误
+	srv := httptest.NewServer(&server)
+	defer srv.Close()
+
+	os.Remove("safemode.dat")
+	defer os.Remove("safemode.dat")
+	defer os.Remove("safemode.dat.etag")
+
+	d := &Downloader{
+		LocalPath: "safemode.dat",
+		RemoteURL: srv.URL,
+	}
+	err := d.EnsureLocal()
+	if err == nil {
+		t.Error("EnsureLocal pass unexpected: SafeMode should block loopback address")
+		t.FailNow()
+	}
+	var blocked *BlockedAddressError
+	if !errors.As(err, &blocked) {
+		t.Errorf("expected error to wrap *BlockedAddressError, got: %s", err.Error())
+		t.FailNow()
+	}
+	if _, statErr := os.Stat("safemode.dat"); statErr == nil {
+		t.Error("LocalPath should not have been created when SafeMode blocks the request")
+		t.FailNow()
+	}
+}
+
+func TestDisableSafeModeAllowsLoopback(t *testing.T) {
+	srv := httptest.NewServer(&server)
+	defer srv.Close()
+
+	os.Remove("safemode2.dat")
+	defer os.Remove("safemode2.dat")
+	defer os.Remove("safemode2.dat.etag")
+
+	d := &Downloader{
+		LocalPath:       "safemode2.dat",
+		RemoteURL:       srv.URL,
+		DisableSafeMode: true,
+	}
+	if err := d.EnsureLocal(); err != nil {
+		t.Error("EnsureLocal fail:", err.Error())
+		t.FailNow()
+	}
+}
+
+type mockFetcher struct{}
+
+func (m *mockFetcher) Resolve(url string) (*Resource, error) { return &Resource{URL: url}, nil }
+func (m *mockFetcher) Start(ctx context.Context) error       { return nil }
+func (m *mockFetcher) Pause() error                          { return nil }
+func (m *mockFetcher) Resume() error                         { return nil }
+func (m *mockFetcher) Status() Status                        { return StatusDone }
+
+func TestRegisterFetcherBuilder(t *testing.T) {
+	// 自定义scheme应当能够替代内置实现参与EnsureLocal流程
+	RegisterFetcherBuilder("mock", func(d *Downloader) Fetcher { return &mockFetcher{} })
+	d := &Downloader{RemoteURL: "mock://test"}
+	if err := d.EnsureLocal(); err != nil {
+		t.Error("EnsureLocal fail:", err.Error())
+		t.FailNow()
+	}
+	if d.Status() != StatusDone {
+		t.Errorf("unexpected status: %s", d.Status())
+		t.FailNow()
+	}
+}
+
+func TestDownloaderPauseResumeIdle(t *testing.T) {
+	// 没有Fetcher（尚未开始过拉取）时，Pause/Resume只作用于轮询循环的挂起门限，不应报错
+	d := &Downloader{}
+	if err := d.Pause(); err != nil {
+		t.Error("Pause fail:", err.Error())
+		t.FailNow()
+	}
+	if err := d.Pause(); err == nil {
+		t.Error("Pause pass unexpected: already paused")
+		t.FailNow()
+	}
+	if err := d.Resume(); err != nil {
+		t.Error("Resume fail:", err.Error())
+		t.FailNow()
+	}
+	if err := d.Resume(); err == nil {
+		t.Error("Resume pass unexpected: not paused")
+		t.FailNow()
+	}
+}
+
+func TestDownloaderPauseForwardsToStartedFetcher(t *testing.T) {
+	// Fetcher处于StatusStarted时，Pause/Resume应当转发给它并驱动其状态迁移
+	d := &Downloader{RemoteURL: "http://127.0.0.1:8787"}
+	fetcher := newHTTPFetcher(d)
+	d.fetcher = fetcher
+	fetcher.(*httpFetcher).setStatus(StatusStarted)
+
+	if err := d.Pause(); err != nil {
+		t.Error("Pause fail:", err.Error())
+		t.FailNow()
+	}
+	if fetcher.Status() != StatusPaused {
+		t.Errorf("unexpected fetcher status: %s", fetcher.Status())
+		t.FailNow()
+	}
+	if err := d.Resume(); err != nil {
+		t.Error("Resume fail:", err.Error())
+		t.FailNow()
+	}
+	if fetcher.Status() != StatusStarted {
+		t.Errorf("unexpected fetcher status: %s", fetcher.Status())
+		t.FailNow()
+	}
+}
+
+func TestPauseResumeConcurrentWithWatch(t *testing.T) {
+	// Pause/Resume在调用方goroutine执行，watchRemote在另一个goroutine里读取同样的
+	// pauseCh/fetcher，需要在-race下验证两者不会互相踩踏
+	server.content = []byte("test content")
+	d := &Downloader{
+		RemoteURL:       "http://127.0.0.1:8787",
+		Interval:        time.Millisecond,
+		DisableSafeMode: true,
+	}
+	go d.StartWatch()
+	defer d.StopWatch()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			d.Pause()
+			time.Sleep(time.Millisecond)
+			d.Resume()
+		}
+	}()
+	<-done
+}
+
+func TestEnsureLocalFileFetcherMissing(t *testing.T) {
+	// RemoteURL为空、LocalPath又不存在时不应静默成功
+	os.Remove("missing.txt")
+	d := &Downloader{LocalPath: "missing.txt"}
+	if err := d.EnsureLocal(); err == nil {
+		t.Error("EnsureLocal pass unexpected: local file is missing and remote url is unset")
+		t.FailNow()
+	}
+	if _, err := os.Stat("missing.txt"); err == nil {
+		t.Error("missing.txt should not have been created")
+		os.Remove("missing.txt")
+		t.FailNow()
+	}
+}
+
 func TestNoWatch(t *testing.T) {
 	d := &Downloader{
 		Interval: 0,
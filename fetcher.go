@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Status 描述Fetcher当前所处的状态
+type Status int
+
+const (
+	// StatusReady 表示Fetcher已创建但尚未开始拉取
+	StatusReady Status = iota
+	// StatusStarted 表示Fetcher正在拉取中
+	StatusStarted
+	// StatusPaused 表示Fetcher已暂停
+	StatusPaused
+	// StatusError 表示上一次拉取出错
+	StatusError
+	// StatusDone 表示上一次拉取已完成
+	StatusDone
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusReady:
+		return "ready"
+	case StatusStarted:
+		return "started"
+	case StatusPaused:
+		return "paused"
+	case StatusError:
+		return "error"
+	case StatusDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// Resource 描述Resolve探测到的远程或本地资源信息
+type Resource struct {
+	URL            string
+	Size           int64
+	ETag           string
+	ModTime        time.Time
+	RangeSupported bool
+}
+
+// Fetcher 是数据拉取的最小抽象，Downloader依据RemoteURL的scheme选择对应实现，
+// 使http/https、file、s3、ftp等协议可以在不改动Downloader核心逻辑的情况下扩展
+type Fetcher interface {
+	// Resolve 探测目标地址的元信息（大小、ETag、修改时间、是否支持分块等），不产生实际拉取
+	Resolve(url string) (*Resource, error)
+
+	// Start 开始一次完整的拉取，直到完成、出错或ctx被取消
+	Start(ctx context.Context) error
+
+	// Pause 暂停正在进行的拉取，若当前未在拉取中则返回错误
+	Pause() error
+
+	// Resume 恢复被暂停的拉取，若当前未处于暂停状态则返回错误
+	Resume() error
+
+	// Status 返回Fetcher当前状态
+	Status() Status
+}
+
+// FetcherBuilder 依据所属的Downloader构造一个Fetcher实例
+type FetcherBuilder func(d *Downloader) Fetcher
+
+var fetcherBuilders = map[string]FetcherBuilder{}
+
+func init() {
+	RegisterFetcherBuilder("http", newHTTPFetcher)
+	RegisterFetcherBuilder("https", newHTTPFetcher)
+	RegisterFetcherBuilder("file", newFileFetcher)
+}
+
+// RegisterFetcherBuilder 注册某个URL scheme对应的FetcherBuilder，用户可借此为
+// s3://、ftp://等协议提供自定义实现，重复注册同一scheme将覆盖之前的实现
+func RegisterFetcherBuilder(scheme string, builder FetcherBuilder) {
+	fetcherBuilders[scheme] = builder
+}
+
+func buildFetcher(d *Downloader, rawURL string) (Fetcher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse remote url fail: %s", err.Error())
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "file"
+	}
+	builder, ok := fetcherBuilders[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported url scheme: %s", scheme)
+	}
+	return builder(d), nil
+}
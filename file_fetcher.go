@@ -0,0 +1,74 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+)
+
+// fileFetcher 是本地文件的Fetcher实现，用于替代watchLocal中原先直接调用os.Stat轮询的方式
+type fileFetcher struct {
+	d *Downloader
+
+	mu     sync.Mutex
+	status Status
+}
+
+func newFileFetcher(d *Downloader) Fetcher {
+	return &fileFetcher{d: d, status: StatusReady}
+}
+
+// Resolve 返回本地文件的大小与修改时间，url参数即本地文件路径
+func (f *fileFetcher) Resolve(path string) (*Resource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Resource{URL: path, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Start 对本地文件而言没有拉取动作，本地模式的更新完全由watchLocal通过Resolve比较修改时间驱动；
+// 本地模式下没有RemoteURL可用于取到数据，因此LocalPath必须已经存在，否则报错，
+// 避免EnsureLocal在文件从未被创建时仍返回成功
+func (f *fileFetcher) Start(ctx context.Context) error {
+	if _, err := os.Stat(f.d.LocalPath); err != nil {
+		f.setStatus(StatusError)
+		return errors.New("remote url is unset")
+	}
+	f.setStatus(StatusDone)
+	return nil
+}
+
+func (f *fileFetcher) Pause() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != StatusStarted {
+		return errors.New("fetcher is not started")
+	}
+	f.status = StatusPaused
+	return nil
+}
+
+func (f *fileFetcher) Resume() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != StatusPaused {
+		return errors.New("fetcher is not paused")
+	}
+	f.status = StatusStarted
+	return nil
+}
+
+func (f *fileFetcher) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+func (f *fileFetcher) setStatus(status Status) {
+	f.mu.Lock()
+	f.status = status
+	f.mu.Unlock()
+	f.d.onStatus(status)
+}
@@ -0,0 +1,475 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// chunk 描述一个分块的下载范围及其完成状态，用于持久化到LocalPath+".progress"以支持断点续传
+type chunk struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	Done   bool  `json:"done"`
+}
+
+// httpFetcher 是http/https的Fetcher实现，沿用之前Downloader.download的行为：
+// 支持ETag条件请求，并在服务器支持Range时按分块并发下载
+type httpFetcher struct {
+	d *Downloader
+
+	mu      sync.Mutex
+	status  Status
+	pauseCh chan struct{}
+}
+
+func newHTTPFetcher(d *Downloader) Fetcher {
+	return &httpFetcher{d: d, status: StatusReady}
+}
+
+// Resolve 探测远程文件大小及是否支持Range请求，通过Range: bytes=0-0的GET请求实现，
+// 部分服务器HEAD请求不返回Content-Length，因此不采用HEAD探测
+func (f *httpFetcher) Resolve(remoteURL string) (*Resource, error) {
+	req, err := http.NewRequest(http.MethodGet, remoteURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	f.d.decorateRequest(req)
+	resp, err := f.d.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	resource := &Resource{URL: remoteURL, ETag: resp.Header.Get("ETag")}
+	if resp.StatusCode == http.StatusPartialContent && resp.Header.Get("Accept-Ranges") == "bytes" {
+		if total, err := parseContentRangeTotal(resp.Header.Get("Content-Range")); err == nil && total > 0 {
+			resource.Size = total
+			resource.RangeSupported = true
+			return resource, nil
+		}
+	}
+	resource.Size = resp.ContentLength
+	return resource, nil
+}
+
+func parseContentRangeTotal(contentRange string) (int64, error) {
+	// 格式形如 "bytes 0-0/12345"
+	idx := lastIndexByte(contentRange, '/')
+	if idx < 0 || idx+1 >= len(contentRange) {
+		return 0, fmt.Errorf("invalid content-range: %s", contentRange)
+	}
+	var total int64
+	if _, err := fmt.Sscanf(contentRange[idx+1:], "%d", &total); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func lastIndexByte(s string, b byte) int {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkRemoteModificationHead 判断远程内容是否已更新，CheckLastModified关闭时使用，沿用原先的
+// HEAD+ETag方式
+func (f *httpFetcher) checkRemoteModificationHead() (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, f.d.RemoteURL, nil)
+	if err != nil {
+		return true, err
+	}
+	f.d.decorateRequest(req)
+	resp, err := f.d.httpClient().Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return true, fmt.Errorf("unexpected status code for modification check: %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return true, errNoETag
+	}
+	return f.d.etag != etag, nil
+}
+
+// checkRemoteModificationGet 在同一个conditional GET请求上同时携带If-None-Match和
+// If-Modified-Since，避免HEAD和后续GET之间出现远程文件恰好被修改的竞态，304响应即视为未更新。
+// 200时把响应连同未读取的body一并返回给调用方，由downloadSingle直接用这个body落盘，避免为了
+// 探测是否更新而丢弃一份body、随后又为了拿内容重新发起一次GET；ETag/Last-Modified也只在内容
+// 真正写入LocalPath成功后才持久化，不在这里提前写入.meta，否则内容落盘失败时.meta已经指向新
+// 版本，下次轮询会被服务端直接返回304，更新被永久吞掉
+func (f *httpFetcher) checkRemoteModificationGet(ctx context.Context) (*http.Response, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, f.d.RemoteURL, nil)
+	if err != nil {
+		return nil, true, err
+	}
+	req = req.WithContext(ctx)
+	if f.d.CheckETag && f.d.etag != "" {
+		req.Header.Set("If-None-Match", f.d.etag)
+	}
+	if f.d.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.d.lastModified)
+	}
+	f.d.decorateRequest(req)
+	resp, err := f.d.httpClient().Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, true, fmt.Errorf("unexpected status code for modification check: %d", resp.StatusCode)
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		if _, err := http.ParseTime(lastModified); err != nil {
+			resp.Body.Close()
+			return nil, true, fmt.Errorf("parse last-modified header fail: %s", err.Error())
+		}
+	}
+	return resp, true, nil
+}
+
+func (f *httpFetcher) metaPath() string {
+	return f.d.LocalPath + ".meta"
+}
+
+type fetchMeta struct {
+	LastModified string `json:"last_modified"`
+}
+
+func (f *httpFetcher) saveLastModified(lastModified string) error {
+	data, err := json.Marshal(fetchMeta{LastModified: lastModified})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.metaPath(), data, 0644)
+}
+
+// Start 拉取远程内容直到完成、出错或ctx被取消：先判断是否需要更新（CheckLastModified开启时
+// 用conditional GET，否则CheckETag开启时用HEAD+ETag），再根据是否支持Range在并发分块下载与
+// 单连接下载之间选择；conditional GET已取回内容时只走单连接下载
+func (f *httpFetcher) Start(ctx context.Context) error {
+	d := f.d
+	if d.RemoteURL == "" {
+		return errors.New("remote url is unset")
+	}
+	f.setStatus(StatusStarted)
+
+	// conditionalResp非空时说明modification检查已经用一次conditional GET把内容本身
+	// 也取回来了，downloadSingle应当直接消费这个body，不再为拿内容重新发起一次GET，
+	// 因此此时不再考虑分块下载
+	var conditionalResp *http.Response
+	if d.CheckLastModified {
+		resp, modified, err := f.checkRemoteModificationGet(ctx)
+		if err != nil {
+			f.setStatus(StatusError)
+			return fmt.Errorf("check remote modification fail: %w", err)
+		}
+		if !modified {
+			f.setStatus(StatusDone)
+			return errNotModified
+		}
+		conditionalResp = resp
+	} else if d.CheckETag {
+		if modified, err := f.checkRemoteModificationHead(); err != nil {
+			f.setStatus(StatusError)
+			return fmt.Errorf("check remote modification fail: %w", err)
+		} else if !modified {
+			f.setStatus(StatusDone)
+			return errNotModified
+		}
+	}
+	if d.Connections > 1 && conditionalResp == nil {
+		resource, err := f.Resolve(d.RemoteURL)
+		if err == nil && resource.RangeSupported && resource.Size > 0 {
+			if err := f.downloadChunked(ctx, resource.Size, resource.ETag); err != nil {
+				f.setStatus(StatusError)
+				return fmt.Errorf("download chunked fail: %s", err.Error())
+			}
+			f.setStatus(StatusDone)
+			return nil
+		}
+		// 探测失败或服务器不支持Range请求时，透明降级为单连接下载
+	}
+	if err := f.downloadSingle(ctx, conditionalResp); err != nil {
+		f.setStatus(StatusError)
+		return err
+	}
+	f.setStatus(StatusDone)
+	return nil
+}
+
+// downloadSingle 将远程内容保存到LocalPath。resp非空时表示内容已经由checkRemoteModificationGet
+// 的conditional GET取回，直接消费它的body，不再重新发起请求；为空时按普通GET请求拉取
+func (f *httpFetcher) downloadSingle(ctx context.Context, resp *http.Response) error {
+	d := f.d
+	if resp == nil {
+		req, err := http.NewRequest(http.MethodGet, d.RemoteURL, nil)
+		if err != nil {
+			return fmt.Errorf("download fail: %s", err.Error())
+		}
+		f.d.decorateRequest(req)
+		resp, err = f.d.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("download fail: %w", err)
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code for download: %d", resp.StatusCode)
+	}
+	partPath := d.LocalPath + ".part"
+	part, err := os.Create(partPath)
+	if err != nil {
+		return fmt.Errorf("create part file fail: %s", err.Error())
+	}
+	written, err := io.Copy(part, resp.Body)
+	part.Close()
+	if err != nil {
+		os.Remove(partPath)
+		return fmt.Errorf("read response body fail: %s", err.Error())
+	}
+	prevPath, err := d.finalize(partPath)
+	if err != nil {
+		return fmt.Errorf("save local file fail: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(d.LocalPath+".etag", []byte(resp.Header.Get("ETag")), 0755); err != nil {
+		return fmt.Errorf("save local etag file fail: %s", err.Error())
+	}
+	d.etag = resp.Header.Get("ETag")
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		if err := f.saveLastModified(lastModified); err != nil {
+			return fmt.Errorf("save last-modified fail: %s", err.Error())
+		}
+		d.lastModified = lastModified
+	}
+	d.prevPath = prevPath
+	d.onProgress(written, written)
+	return nil
+}
+
+func (f *httpFetcher) progressPath() string {
+	return f.d.LocalPath + ".progress"
+}
+
+func (f *httpFetcher) loadProgress(total int64) []chunk {
+	data, err := ioutil.ReadFile(f.progressPath())
+	if err != nil {
+		return nil
+	}
+	var chunks []chunk
+	if err := json.Unmarshal(data, &chunks); err != nil {
+		return nil
+	}
+	var sum int64
+	for _, c := range chunks {
+		sum += c.Length
+	}
+	if sum != total {
+		// 远程文件大小已变化，放弃已有进度重新分块
+		return nil
+	}
+	return chunks
+}
+
+func (f *httpFetcher) saveProgress(chunks []chunk) error {
+	data, err := json.Marshal(chunks)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.progressPath(), data, 0644)
+}
+
+func (f *httpFetcher) splitChunks(total int64) []chunk {
+	d := f.d
+	connections := d.Connections
+	if connections < 1 {
+		connections = 1
+	}
+	chunkSize := d.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = total / int64(connections)
+		if chunkSize <= 0 {
+			chunkSize = total
+		}
+	}
+	var chunks []chunk
+	for offset := int64(0); offset < total; offset += chunkSize {
+		length := chunkSize
+		if offset+length > total {
+			length = total - offset
+		}
+		chunks = append(chunks, chunk{Offset: offset, Length: length})
+	}
+	return chunks
+}
+
+// downloadChunked 将远程文件按Range请求拆分为多个分块并发下载到LocalPath+".part"，
+// 分块进度持久化到LocalPath+".progress"以便中断后恢复，全部分块完成后再rename为LocalPath，
+// 避免EnsureLocal/watchRemote读到写了一半的文件
+func (f *httpFetcher) downloadChunked(ctx context.Context, total int64, etag string) error {
+	d := f.d
+	partPath := d.LocalPath + ".part"
+	part, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("open part file fail: %s", err.Error())
+	}
+	defer part.Close()
+	if err := part.Truncate(total); err != nil {
+		return fmt.Errorf("truncate part file fail: %s", err.Error())
+	}
+
+	chunks := f.loadProgress(total)
+	if chunks == nil {
+		chunks = f.splitChunks(total)
+	}
+
+	var downloaded int64
+	for _, c := range chunks {
+		if c.Done {
+			atomic.AddInt64(&downloaded, c.Length)
+		}
+	}
+	d.onProgress(downloaded, total)
+
+	group, gctx := errgroup.WithContext(ctx)
+	for i := range chunks {
+		i := i
+		if chunks[i].Done {
+			continue
+		}
+		group.Go(func() error {
+			return f.downloadChunk(gctx, part, &chunks[i], &downloaded, total)
+		})
+	}
+	if err := group.Wait(); err != nil {
+		f.saveProgress(chunks)
+		return err
+	}
+
+	os.Remove(f.progressPath())
+	if err := part.Close(); err != nil {
+		return fmt.Errorf("close part file fail: %s", err.Error())
+	}
+	prevPath, err := d.finalize(partPath)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(d.LocalPath+".etag", []byte(etag), 0755); err != nil {
+		return fmt.Errorf("save local etag file fail: %s", err.Error())
+	}
+	d.etag = etag
+	d.prevPath = prevPath
+	return nil
+}
+
+func (f *httpFetcher) downloadChunk(ctx context.Context, part *os.File, c *chunk, downloaded *int64, total int64) error {
+	req, err := http.NewRequest(http.MethodGet, f.d.RemoteURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", c.Offset, c.Offset+c.Length-1))
+	f.d.decorateRequest(req)
+	resp, err := f.d.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("download chunk fail: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected status code for range request: %d", resp.StatusCode)
+	}
+	buf := make([]byte, 32*1024)
+	offset := c.Offset
+	for {
+		f.waitIfPaused()
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := part.WriteAt(buf[:n], offset); werr != nil {
+				return fmt.Errorf("write part file fail: %s", werr.Error())
+			}
+			offset += int64(n)
+			atomic.AddInt64(downloaded, int64(n))
+			f.d.onProgress(atomic.LoadInt64(downloaded), total)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return fmt.Errorf("read chunk body fail: %s", rerr.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+	c.Done = true
+	return nil
+}
+
+func (f *httpFetcher) Pause() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != StatusStarted {
+		return errors.New("fetcher is not started")
+	}
+	f.status = StatusPaused
+	f.pauseCh = make(chan struct{})
+	return nil
+}
+
+func (f *httpFetcher) Resume() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != StatusPaused {
+		return errors.New("fetcher is not paused")
+	}
+	close(f.pauseCh)
+	f.pauseCh = nil
+	f.status = StatusStarted
+	return nil
+}
+
+func (f *httpFetcher) waitIfPaused() {
+	f.mu.Lock()
+	ch := f.pauseCh
+	f.mu.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
+
+func (f *httpFetcher) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+func (f *httpFetcher) setStatus(status Status) {
+	f.mu.Lock()
+	f.status = status
+	f.mu.Unlock()
+	f.d.onStatus(status)
+}
@@ -0,0 +1,37 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+)
+
+// BlockedAddressError 表示目标地址命中了BlockedCIDRs中的某个网段而被拒绝连接，
+// ErrorCallback可以借此区分是策略拦截还是普通的网络故障
+type BlockedAddressError struct {
+	Address string
+}
+
+func (e *BlockedAddressError) Error() string {
+	return fmt.Sprintf("blocked address: %s", e.Address)
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipnet
+}
+
+// defaultBlockedCIDRs 覆盖RFC1918私有地址、回环地址和链路本地地址，用于SafeMode默认拦截
+// 内网/元数据端点，防止RemoteURL被配置为用户可控的地址时引发SSRF
+var defaultBlockedCIDRs = []*net.IPNet{
+	mustParseCIDR("127.0.0.0/8"),
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("169.254.0.0/16"),
+	mustParseCIDR("::1/128"),
+	mustParseCIDR("fe80::/10"),
+	mustParseCIDR("fc00::/7"),
+}